@@ -0,0 +1,29 @@
+// Copyright 2018-2019 Shift Cryptosecurity AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package common contains types shared between the BitBox02 firmware API and the BitBoxBase API.
+package common
+
+// Product identifies the product running on the other end of the connection, as the API differs
+// slightly between them (e.g. available endpoints, screen size).
+type Product string
+
+const (
+	// ProductBitBox02Multi is the BitBox02 multi-coin edition.
+	ProductBitBox02Multi Product = "bitbox02-multi"
+	// ProductBitBox02BTCOnly is the BitBox02 Bitcoin-only edition.
+	ProductBitBox02BTCOnly Product = "bitbox02-btconly"
+	// ProductBitBoxBaseStandard is the BitBoxBase standard edition.
+	ProductBitBoxBaseStandard Product = "bitbox-base-standard"
+)
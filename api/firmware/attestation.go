@@ -0,0 +1,201 @@
+// Copyright 2018-2019 Shift Cryptosecurity AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firmware
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/digitalbitbox/bitbox02-api-go/util/errp"
+)
+
+const (
+	attestationBootloaderHashLen = 32
+	attestationDevicePubkeyLen   = 64
+	attestationCertificateLen    = 64
+	AttestationRootIdentifierLen = 32
+	attestationChallengeLen      = 32
+	attestationChallengeSigLen   = 64
+	attestationPayloadLen        = 1 + attestationBootloaderHashLen + attestationDevicePubkeyLen +
+		attestationCertificateLen + AttestationRootIdentifierLen + attestationChallengeSigLen
+)
+
+// AttestationRoot is a Shift attestation root public key, indexed by rootPubkeyIdentifier.
+type AttestationRoot struct {
+	identifier [AttestationRootIdentifierLen]byte
+	pubkey     ed25519.PublicKey
+}
+
+// defaultAttestationRoots are the root attestation pubkeys compiled into this library. Devices
+// attesting against an unknown root are untrusted.
+//
+// TODO: this is currently a stub - no real production root pubkey is compiled in yet, so every
+// caller that does not pass WithAttestationRoots will have Attestation() (and therefore Init())
+// fail closed with StatusAttestationFailed against real hardware. See TestInitDefaultAttestationRoots.
+var defaultAttestationRoots []AttestationRoot
+
+// WithAttestationRoots overrides the compiled-in attestation root pubkeys. Intended for tests;
+// production callers should use the default (currently a stub - see defaultAttestationRoots).
+func WithAttestationRoots(roots ...AttestationRoot) Option {
+	return func(device *Device) {
+		device.attestationRoots = roots
+	}
+}
+
+// NewAttestationRoot builds an attestation root usable with WithAttestationRoots.
+func NewAttestationRoot(identifier [AttestationRootIdentifierLen]byte, pubkey ed25519.PublicKey) AttestationRoot {
+	return AttestationRoot{identifier: identifier, pubkey: pubkey}
+}
+
+// AttestationResult is the parsed and verified OP_ATTESTATION payload.
+type AttestationResult struct {
+	// Trusted is true if the certificate chains to a known root and the device proved possession
+	// of DevicePubkey by signing the challenge.
+	Trusted bool
+
+	BootloaderHash       [attestationBootloaderHashLen]byte
+	DevicePubkey         ed25519.PublicKey
+	Certificate          [attestationCertificateLen]byte
+	RootPubkeyIdentifier [AttestationRootIdentifierLen]byte
+	ChallengeSignature   [attestationChallengeSigLen]byte
+}
+
+// DeviceIdentifier is a stable identifier for the device, derived from its attested pubkey. Host
+// applications can pin this the way an ACME `device-attest-01` validator pins the leaf fingerprint
+// (it does not change across re-pairing or firmware upgrades).
+func (result *AttestationResult) DeviceIdentifier() string {
+	sum := sha256.Sum256(result.DevicePubkey)
+	return fmt.Sprintf("%x", sum)
+}
+
+// AttestationStatus is cached on Init() and reflects the outcome of the attestation performed
+// there.
+func (device *Device) AttestationStatus() Status {
+	if device.attestationResult == nil {
+		return StatusConnected
+	}
+	if !device.attestationResult.Trusted {
+		return StatusAttestationFailed
+	}
+	return StatusInitialized
+}
+
+// Attestation performs (or returns the cached result of) the OP_ATTESTATION ceremony: it parses
+// the device's attestation payload, verifies the certificate against the compiled-in (or injected
+// via WithAttestationRoots) root pubkeys, signs a fresh challenge with the device and verifies the
+// signature against the attested device pubkey.
+func (device *Device) Attestation() (*AttestationResult, error) {
+	if device.attestationResult != nil {
+		if !device.attestationResult.Trusted {
+			return device.attestationResult, errp.New("attestation previously failed")
+		}
+		return device.attestationResult, nil
+	}
+
+	payload, err := device.rawQuery([]byte(opAttestation))
+	if err != nil {
+		return nil, err
+	}
+	result, err := parseAttestation(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	root, ok := findAttestationRoot(device.attestationRoots, result.RootPubkeyIdentifier)
+	if !ok || !ed25519.Verify(root.pubkey, result.DevicePubkey, result.Certificate[:]) {
+		device.attestationResult = result
+		device.setStatus(StatusAttestationFailed)
+		return result, errp.New("attestation certificate does not chain to a known root")
+	}
+
+	challenge := make([]byte, attestationChallengeLen)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, errp.WithStack(err)
+	}
+	if _, err := device.signChallenge(result.DevicePubkey, challenge); err != nil {
+		device.attestationResult = result
+		device.setStatus(StatusAttestationFailed)
+		return result, err
+	}
+
+	result.Trusted = true
+	device.attestationResult = result
+	return result, nil
+}
+
+// SignAttestationChallenge has the device sign challenge with its attested key, the same key used
+// internally by Attestation(). It is exported for callers that need the device to prove
+// possession of its attested key for a purpose other than Attestation() itself (e.g. an enrollment
+// ceremony nonce). It requires a prior successful Attestation().
+func (device *Device) SignAttestationChallenge(challenge []byte) ([]byte, error) {
+	if device.attestationResult == nil || !device.attestationResult.Trusted {
+		return nil, errp.New("device attestation has not succeeded")
+	}
+	return device.signChallenge(device.attestationResult.DevicePubkey, challenge)
+}
+
+// signChallenge has the device sign challenge via OP_ATTESTATION and verifies the signature
+// against devicePubkey.
+func (device *Device) signChallenge(devicePubkey ed25519.PublicKey, challenge []byte) ([]byte, error) {
+	if len(challenge) != attestationChallengeLen {
+		return nil, errp.Newf("challenge must be %d bytes", attestationChallengeLen)
+	}
+	signature, err := device.rawQuery(append([]byte(opAttestation), challenge...))
+	if err != nil {
+		return nil, err
+	}
+	if len(signature) != attestationChallengeSigLen || !ed25519.Verify(devicePubkey, challenge, signature) {
+		return nil, errp.New("attestation challenge signature is invalid")
+	}
+	return signature, nil
+}
+
+// Device pubkeys and certificates are ed25519 (32- and 64-byte respectively), but the wire format
+// reserves a 64-byte slot for the device pubkey to also accommodate larger key types from older
+// bootloaders; only the leading ed25519.PublicKeySize bytes of that slot are meaningful.
+func parseAttestation(payload []byte) (*AttestationResult, error) {
+	if len(payload) != attestationPayloadLen {
+		return nil, errp.New("malformed attestation payload")
+	}
+	offset := 1 // first byte is a status/version marker, currently unused
+	result := &AttestationResult{}
+
+	copy(result.BootloaderHash[:], payload[offset:offset+attestationBootloaderHashLen])
+	offset += attestationBootloaderHashLen
+
+	devicePubkeySlot := payload[offset : offset+attestationDevicePubkeyLen]
+	result.DevicePubkey = append(ed25519.PublicKey{}, devicePubkeySlot[:ed25519.PublicKeySize]...)
+	offset += attestationDevicePubkeyLen
+
+	copy(result.Certificate[:], payload[offset:offset+attestationCertificateLen])
+	offset += attestationCertificateLen
+
+	copy(result.RootPubkeyIdentifier[:], payload[offset:offset+AttestationRootIdentifierLen])
+	offset += AttestationRootIdentifierLen
+
+	copy(result.ChallengeSignature[:], payload[offset:offset+attestationChallengeSigLen])
+	return result, nil
+}
+
+func findAttestationRoot(roots []AttestationRoot, identifier [AttestationRootIdentifierLen]byte) (AttestationRoot, bool) {
+	for _, root := range roots {
+		if root.identifier == identifier {
+			return root, true
+		}
+	}
+	return AttestationRoot{}, false
+}
@@ -0,0 +1,564 @@
+// Copyright 2018-2019 Shift Cryptosecurity AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package firmware implements the BitBox02 USB/HID firmware API: pairing, encrypted request/
+// response and the individual device endpoints (seed generation, signing, etc.).
+package firmware
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"github.com/digitalbitbox/bitbox02-api-go/api/common"
+	"github.com/digitalbitbox/bitbox02-api-go/api/firmware/messages"
+	"github.com/digitalbitbox/bitbox02-api-go/util/errp"
+	"github.com/digitalbitbox/bitbox02-api-go/util/semver"
+	"github.com/flynn/noise"
+	"github.com/golang/protobuf/proto"
+)
+
+// noiseCipherSuite is the fixed Noise_XX_25519_ChaChaPoly_SHA256 cipher suite used for the app/
+// device pairing handshake. It carries no per-connection state, so one instance is shared.
+var noiseCipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+
+const (
+	opICanHasHandShaek          = "h"
+	opICanHasPairinVerificaShun = "v"
+	opNoiseMsg                  = "n"
+	opAttestation               = "a"
+	opUnlock                    = "u"
+
+	responseSuccess = 0x00
+)
+
+// TstLowestNonSupportedFirmwareVersion is exported for tests: any firmware at or above this
+// version speaks a protocol this library does not understand yet and must not be queried further.
+var TstLowestNonSupportedFirmwareVersion = semver.NewSemVer(9, 0, 0)
+
+// TstLowestSupportedFirmwareVersions is exported for tests: the minimum firmware version this
+// library supports, per product. Devices below this need a firmware upgrade before anything else
+// can happen.
+var TstLowestSupportedFirmwareVersions = map[common.Product]*semver.SemVer{
+	common.ProductBitBox02Multi:      semver.NewSemVer(2, 0, 0),
+	common.ProductBitBox02BTCOnly:    semver.NewSemVer(2, 0, 0),
+	common.ProductBitBoxBaseStandard: semver.NewSemVer(2, 0, 0),
+}
+
+// Status is the device pairing/initialization status, as observed by the app.
+type Status string
+
+const (
+	// StatusConnected means the device is connected but Init() has not run yet.
+	StatusConnected Status = "connected"
+	// StatusRequireAppUpgrade means the device firmware is newer than this library understands.
+	StatusRequireAppUpgrade Status = "require_app_upgrade"
+	// StatusRequireFirmwareUpgrade means the device firmware is older than this library requires.
+	StatusRequireFirmwareUpgrade Status = "require_firmware_upgrade"
+	// StatusPairingFailed means the user rejected the pairing code on the device.
+	StatusPairingFailed Status = "pairing_failed"
+	// StatusUninitialized means the device has not been seeded yet.
+	StatusUninitialized Status = "uninitialized"
+	// StatusInitialized means the device is seeded and ready for use.
+	StatusInitialized Status = "initialized"
+	// StatusAttestationFailed means the device's attestation certificate did not chain to a known
+	// root, or the device failed to prove possession of its attested key.
+	StatusAttestationFailed Status = "attestation_failed"
+)
+
+// Communication abstracts the underlying USB/HID transport.
+type Communication interface {
+	SendFrame(msg string) error
+	Query(msg []byte) ([]byte, error)
+	Close()
+}
+
+// Config abstracts app-side persisted pairing state.
+type Config interface {
+	ContainsDeviceStaticPubkey(pubkey []byte) bool
+	AddDeviceStaticPubkey(pubkey []byte) error
+	// RemoveDeviceStaticPubkey revokes the app's trust of a previously-added device static
+	// pubkey, e.g. because the app forgot the device or rotated its own keypair.
+	RemoveDeviceStaticPubkey(pubkey []byte) error
+	GetAppNoiseStaticKeypair() *noise.DHKey
+	SetAppNoiseStaticKeypair(key *noise.DHKey) error
+}
+
+// Logger abstracts app-side logging so this library stays agnostic of the logging framework used.
+type Logger interface {
+	Error(msg string, err error)
+	Info(msg string)
+	Debug(msg string)
+}
+
+// Device models a BitBox02 (or BitBoxBase) connected over Communication.
+type Device struct {
+	communication Communication
+	version       *semver.SemVer
+	product       common.Product
+	config        Config
+	log           Logger
+
+	status Status
+
+	sendCipher, receiveCipher *noise.CipherState
+
+	// negotiatedMaxMsgSize is min(local, remote) from the handshake options exchanged in pair().
+	// Zero means negotiation did not happen (pre-4.0.0 firmware, or firmware that did not echo
+	// options back), in which case query()/UpgradeFirmware() fall back to one frame per message.
+	negotiatedMaxMsgSize uint32
+
+	// devicePubkey is the device's Noise static pubkey, as seen in the most recently completed
+	// handshake. It is what RotateAppNoiseKey and ForgetDevice operate on in device.config.
+	devicePubkey []byte
+
+	attestationResult *AttestationResult
+	attestationRoots  []AttestationRoot
+
+	eventsMu         sync.Mutex
+	eventSubscribers map[int]chan Event
+	nextSubscriberID int
+	eventSeq         uint64
+}
+
+// NewDevice creates a new Device. `version` and `product` are usually learned out-of-band (e.g.
+// from the USB descriptor) before the encrypted channel in Init() can be established.
+func NewDevice(
+	version *semver.SemVer,
+	product *common.Product,
+	config Config,
+	communication Communication,
+	log Logger,
+	options ...Option,
+) *Device {
+	device := &Device{
+		communication:    communication,
+		version:          version,
+		product:          *product,
+		config:           config,
+		log:              log,
+		status:           StatusConnected,
+		attestationRoots: defaultAttestationRoots,
+	}
+	for _, option := range options {
+		option(device)
+	}
+	return device
+}
+
+// Option configures optional, non-default Device behavior.
+type Option func(*Device)
+
+// Version returns the firmware version.
+func (device *Device) Version() *semver.SemVer {
+	return device.version
+}
+
+// Product returns the connected product.
+func (device *Device) Product() common.Product {
+	return device.product
+}
+
+// Status returns the current pairing/initialization status.
+func (device *Device) Status() Status {
+	device.eventsMu.Lock()
+	defer device.eventsMu.Unlock()
+	return device.status
+}
+
+// Close releases the underlying communication resources.
+func (device *Device) Close() {
+	device.communication.Close()
+}
+
+// Init sets up the encrypted channel with the device: attestation, unlock attempt and the Noise
+// pairing handshake. It must be called once after construction and before any other method.
+func (device *Device) Init() error {
+	if device.version.AtLeast(TstLowestNonSupportedFirmwareVersion) {
+		device.setStatus(StatusRequireAppUpgrade)
+		return nil
+	}
+
+	if device.version.AtLeast(semver.NewSemVer(2, 0, 0)) {
+		if _, err := device.Attestation(); err != nil {
+			device.logError("attestation failed", err)
+			if device.Status() != StatusAttestationFailed {
+				// No verdict on the device was reached (e.g. a query error or a malformed
+				// payload), so report the error itself.
+				return err
+			}
+			// device.status is already StatusAttestationFailed; surface it to the caller instead
+			// of continuing the pairing flow with an untrusted device.
+			return nil
+		}
+		if _, err := device.rawQuery([]byte(opUnlock)); err != nil {
+			return err
+		}
+	}
+
+	return device.pair()
+}
+
+// pair runs the Noise XX handshake and, if the device requests it, pairing verification.
+func (device *Device) pair() error {
+	keypair := device.config.GetAppNoiseStaticKeypair()
+	if keypair == nil {
+		cipherSuite := noiseCipherSuite
+		generated, err := cipherSuite.GenerateKeypair(nil)
+		if err != nil {
+			return errp.WithStack(err)
+		}
+		keypair = &generated
+	}
+
+	result, err := device.runNoiseHandshake(*keypair)
+	if err != nil {
+		if err == errPairingRejected {
+			device.setStatus(StatusPairingFailed)
+		}
+		return err
+	}
+	// Record trust, and only then switch the Device over to the new session: if persisting the
+	// pubkey fails, the caller's error means what it says and this Device is left with no usable
+	// cipher, rather than a live session the app never actually recorded as trusted.
+	if err := device.config.AddDeviceStaticPubkey(result.peerStatic); err != nil {
+		return errp.WithStack(err)
+	}
+	device.sendCipher, device.receiveCipher = result.sendCipher, result.receiveCipher
+	device.negotiatedMaxMsgSize = result.negotiatedMaxMsgSize
+	device.devicePubkey = result.peerStatic
+	return nil
+}
+
+// noiseHandshakeResult is what a completed Noise XX handshake establishes.
+type noiseHandshakeResult struct {
+	sendCipher, receiveCipher *noise.CipherState
+	peerStatic                []byte
+	negotiatedMaxMsgSize      uint32
+}
+
+// errPairingRejected is returned by runNoiseHandshake when the device reports that the user
+// declined the pairing code shown on it.
+var errPairingRejected = errp.New("pairing rejected on device")
+
+// runNoiseHandshake runs the Noise XX handshake using keypair as this side's static key and, if
+// the device requests it, on-device pairing verification. It is used both for the initial pairing
+// in pair() and to re-key in RotateAppNoiseKey; neither device.sendCipher/receiveCipher nor
+// device.status are touched here - callers decide what a result or failure means for those.
+func (device *Device) runNoiseHandshake(keypair noise.DHKey) (*noiseHandshakeResult, error) {
+	device.emit(Event{Type: EventHandshakeStarted})
+	cipherSuite := noiseCipherSuite
+	handshake, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   cipherSuite,
+		Pattern:       noise.HandshakeXX,
+		StaticKeypair: keypair,
+		Prologue:      []byte("Noise_XX_25519_ChaChaPoly_SHA256"),
+		Initiator:     true,
+	})
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+
+	response, err := device.rawQuery([]byte(opICanHasHandShaek))
+	if err != nil {
+		return nil, err
+	}
+	if response[0] != responseSuccess {
+		return nil, errp.New("could not start handshake")
+	}
+
+	// Noise_XX has three messages: e / e,ee,s,es / s,es. As the initiator, we write message 1,
+	// read message 2, then write message 3 - which completes our side of the handshake. The
+	// response to message 3 is not a handshake message: it is the device's pairing-verification
+	// requirement byte (see OP_I_CAN_HAS_PAIRIN_VERIFICASHUN below).
+	//
+	// Message 1's payload (sent in the clear; message 1 carries no encryption key yet) and
+	// message 2's payload (encrypted once 'ee' has run) double as an append-only options
+	// exchange: we advertise our framing capability, and a device new enough to understand it
+	// echoes its own back. A device that does not (pre-4.0.0, or early 4.x before this was
+	// added) simply leaves message 2's payload empty, and negotiatedMaxMsgSize stays zero -
+	// query()/UpgradeFirmware() then fall back to today's single-frame-per-message behavior.
+	localOptions := handshakeOptions{maxMsgSize: defaultMaxMsgSize}
+	var msg1Payload []byte
+	if device.version.AtLeast(semver.NewSemVer(4, 0, 0)) {
+		msg1Payload = encodeHandshakeOptions(localOptions)
+	}
+	msg1, _, _, err := handshake.WriteMessage(nil, msg1Payload)
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+	msg2, err := device.rawQuery(msg1)
+	if err != nil {
+		return nil, err
+	}
+	remotePayload, _, _, err := handshake.ReadMessage(nil, msg2)
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+	var negotiatedMaxMsgSize uint32
+	if remoteOptions, err := decodeHandshakeOptions(remotePayload); err == nil {
+		negotiatedMaxMsgSize = localOptions.maxMsgSize
+		if remoteOptions.maxMsgSize < negotiatedMaxMsgSize {
+			negotiatedMaxMsgSize = remoteOptions.maxMsgSize
+		}
+	}
+	msg3, sendCipher, receiveCipher, err := handshake.WriteMessage(nil, nil)
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+	pairingRequired, err := device.rawQuery(msg3)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &noiseHandshakeResult{
+		sendCipher:           sendCipher,
+		receiveCipher:        receiveCipher,
+		peerStatic:           handshake.PeerStatic(),
+		negotiatedMaxMsgSize: negotiatedMaxMsgSize,
+	}
+
+	if len(pairingRequired) > 0 && pairingRequired[0] != 0 {
+		device.emit(Event{Type: EventPairingVerificationRequired})
+		response, err := device.rawQuery([]byte(opICanHasPairinVerificaShun))
+		if err != nil {
+			return nil, err
+		}
+		if response[0] != responseSuccess {
+			return nil, errPairingRejected
+		}
+	}
+	return result, nil
+}
+
+// minNoiseKeyRotationFirmwareVersion is the lowest firmware version RotateAppNoiseKey supports.
+var minNoiseKeyRotationFirmwareVersion = semver.NewSemVer(4, 0, 0)
+
+// RotateAppNoiseKey replaces the app's Noise pairing keypair with a freshly generated one and
+// re-runs the pairing handshake, which requires the user to re-confirm the new pairing code shown
+// on the device. The old keypair, and the app's trust of the device's current static pubkey, are
+// only replaced once that re-verification succeeds; if the user rejects it the existing keypair
+// and trust are left untouched, so the device remains usable with the old identity.
+//
+// RotateAppNoiseKey requires a device that is already paired (Init() has run) and firmware new
+// enough to support it; older firmware returns ErrUnsupportedByFirmware.
+//
+// ctx is checked before the handshake starts but, like Communication itself, is not plumbed into
+// the underlying Query() calls, so it cannot interrupt a handshake already waiting on the device.
+func (device *Device) RotateAppNoiseKey(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !device.version.AtLeast(minNoiseKeyRotationFirmwareVersion) {
+		return &ErrUnsupportedByFirmware{
+			Feature: "RotateAppNoiseKey",
+			Minimum: minNoiseKeyRotationFirmwareVersion,
+		}
+	}
+	if device.sendCipher == nil {
+		return errp.New("device is not paired")
+	}
+
+	cipherSuite := noiseCipherSuite
+	newKeypair, err := cipherSuite.GenerateKeypair(nil)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+
+	result, err := device.runNoiseHandshake(newKeypair)
+	if err != nil {
+		return err
+	}
+
+	// Persist in an order that fails safe: add the new trust entry (additive, harmless if
+	// something below still fails), then the new keypair (the old one still works until the old
+	// trust entry below is actually removed), then drop the old trust entry last. A device's
+	// Noise static key does not change just because the app rotated its own keypair, so
+	// result.peerStatic is usually identical to the old device.devicePubkey - only remove the old
+	// entry if it actually differs, or this would immediately revoke the trust it just re-added.
+	if err := device.config.AddDeviceStaticPubkey(result.peerStatic); err != nil {
+		return errp.WithStack(err)
+	}
+	if err := device.config.SetAppNoiseStaticKeypair(&newKeypair); err != nil {
+		return errp.WithStack(err)
+	}
+	if device.devicePubkey != nil && !bytes.Equal(device.devicePubkey, result.peerStatic) {
+		if err := device.config.RemoveDeviceStaticPubkey(device.devicePubkey); err != nil {
+			return errp.WithStack(err)
+		}
+	}
+
+	device.sendCipher, device.receiveCipher = result.sendCipher, result.receiveCipher
+	device.negotiatedMaxMsgSize = result.negotiatedMaxMsgSize
+	device.devicePubkey = result.peerStatic
+	return nil
+}
+
+// ForgetDevice removes the app's trust of the current device's static pubkey from device.config.
+// Init() does not consult that trusted set (Config.ContainsDeviceStaticPubkey): whether on-device
+// pairing verification runs on the next Init() is decided by the device's handshake response alone.
+func (device *Device) ForgetDevice() error {
+	if device.devicePubkey == nil {
+		return errp.New("device is not paired")
+	}
+	return device.config.RemoveDeviceStaticPubkey(device.devicePubkey)
+}
+
+// ChannelHashVerify finalizes pairing once the user has confirmed (or not) the channel hash shown
+// by the app and on the device. It fetches DeviceInfo() to determine whether the device has
+// already been seeded.
+func (device *Device) ChannelHashVerify(ok bool) {
+	if !ok {
+		device.setStatus(StatusPairingFailed)
+		return
+	}
+	deviceInfo, err := device.DeviceInfo()
+	if err != nil {
+		device.logError("could not query device-info", err)
+		return
+	}
+
+	lowestSupported, ok := TstLowestSupportedFirmwareVersions[device.product]
+	if ok && !device.version.AtLeast(lowestSupported) {
+		device.setStatus(StatusRequireFirmwareUpgrade)
+		return
+	}
+
+	if deviceInfo.Initialized {
+		device.setStatus(StatusInitialized)
+	} else {
+		device.setStatus(StatusUninitialized)
+	}
+}
+
+// DeviceInfo queries the device's product, initialization state and firmware version.
+func (device *Device) DeviceInfo() (*messages.DeviceInfoResponse, error) {
+	request := &messages.Request{
+		Request: &messages.Request_DeviceInfo{DeviceInfo: &messages.DeviceInfoRequest{}},
+	}
+	response, err := device.query(request)
+	if err != nil {
+		return nil, err
+	}
+	deviceInfo, ok := response.Response.(*messages.Response_DeviceInfo)
+	if !ok {
+		return nil, errp.New("unexpected response")
+	}
+	return deviceInfo.DeviceInfo, nil
+}
+
+// UpgradeFirmware tells the device to reboot into the bootloader so the host application can
+// flash new firmware.
+func (device *Device) UpgradeFirmware() error {
+	request := &messages.Request{
+		Request: &messages.Request_Reboot{Reboot: &messages.RebootRequest{}},
+	}
+	requestBytes, err := proto.Marshal(request)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	encrypted, err := device.sendCipher.Encrypt(nil, nil, requestBytes)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	switch device.noiseFraming() {
+	case framingChunked:
+		if err := device.sendChunkedFrame(encrypted); err != nil {
+			return err
+		}
+	case framingPlain:
+		if err := device.communication.SendFrame(string(append([]byte(opNoiseMsg), encrypted...))); err != nil {
+			return err
+		}
+	default:
+		if err := device.communication.SendFrame(string(encrypted)); err != nil {
+			return err
+		}
+	}
+	device.emit(Event{Type: EventFirmwareUpgradeReboot})
+	return nil
+}
+
+// Random returns 32 bytes of random data generated by the device's TRNG.
+func (device *Device) Random() ([]byte, error) {
+	request := &messages.Request{
+		Request: &messages.Request_RandomNumber{RandomNumber: &messages.RandomNumberRequest{}},
+	}
+	response, err := device.query(request)
+	if err != nil {
+		return nil, err
+	}
+	randomNumber, ok := response.Response.(*messages.Response_RandomNumber)
+	if !ok {
+		return nil, errp.New("unexpected response")
+	}
+	return randomNumber.RandomNumber.Number, nil
+}
+
+// SetDeviceName sets the device's user-visible name.
+func (device *Device) SetDeviceName(name string) error {
+	if len(name) > 64 {
+		return errp.New("name too long")
+	}
+	request := &messages.Request{
+		Request: &messages.Request_DeviceName{DeviceName: &messages.DeviceNameRequest{Name: name}},
+	}
+	response, err := device.query(request)
+	if err != nil {
+		return err
+	}
+	if _, ok := response.Response.(*messages.Response_Success); !ok {
+		return errp.New("unexpected response")
+	}
+	return nil
+}
+
+// query encrypts and sends a protobuf request and decrypts/unmarshals the protobuf response.
+func (device *Device) query(request *messages.Request) (*messages.Response, error) {
+	requestBytes, err := proto.Marshal(request)
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+	encryptedRequest, err := device.sendCipher.Encrypt(nil, nil, requestBytes)
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+	var responseBytes []byte
+	switch device.noiseFraming() {
+	case framingChunked:
+		responseBytes, err = device.sendChunked(encryptedRequest)
+	case framingPlain:
+		responseBytes, err = device.rawQuery(append([]byte(opNoiseMsg), encryptedRequest...))
+	default:
+		responseBytes, err = device.rawQuery(encryptedRequest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := device.receiveCipher.Decrypt(nil, nil, responseBytes)
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+	response := &messages.Response{}
+	if err := proto.Unmarshal(decrypted, response); err != nil {
+		return nil, errp.WithStack(err)
+	}
+	return response, nil
+}
+
+// rawQuery performs a Query() on the underlying communication channel without any framing/
+// encryption applied.
+func (device *Device) rawQuery(msg []byte) ([]byte, error) {
+	return device.communication.Query(msg)
+}
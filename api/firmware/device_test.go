@@ -15,9 +15,12 @@
 package firmware_test
 
 import (
+	"context"
+	"crypto/ed25519"
 	"crypto/rand"
 	"errors"
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/digitalbitbox/bitbox02-api-go/api/common"
@@ -29,6 +32,33 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// makeAttestation builds a well-formed OP_ATTESTATION payload (see firmware.AttestationResult)
+// signed by rootKey, identified by rootIdentifier. Passing a different rootKey than the one
+// registered with firmware.WithAttestationRoots produces a payload that fails attestation.
+func makeAttestation(
+	t *testing.T,
+	rootIdentifier [32]byte,
+	rootKey ed25519.PrivateKey,
+) (devicePubkey ed25519.PublicKey, deviceKey ed25519.PrivateKey, payload []byte) {
+	devicePubkey, deviceKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	certificate := ed25519.Sign(rootKey, devicePubkey)
+	require.Len(t, certificate, 64)
+
+	// Field widths must match firmware.parseAttestation: 1 (marker) + 32 (bootloader hash) +
+	// 64 (device pubkey slot, only the first 32 bytes used for ed25519) + 64 (certificate) +
+	// 32 (root identifier) + 64 (challenge signature, left as zero here).
+	payload = make([]byte, 1+32+64+64+32+64)
+	offset := 1 + 32 // bootloader hash left as zero in these tests
+	copy(payload[offset:], devicePubkey)
+	offset += 64
+	copy(payload[offset:], certificate)
+	offset += 64
+	copy(payload[offset:], rootIdentifier[:])
+	return devicePubkey, deviceKey, payload
+}
+
 type communicationMock struct {
 	sendFrame func(msg string) error
 	query     func([]byte) ([]byte, error)
@@ -47,18 +77,32 @@ func (communication *communicationMock) Close() {
 	communication.close()
 }
 
-type configMock struct{}
+// configMock's zero value behaves like the old stateless mock (no trusted pubkeys, no stored
+// keypair); tests that care about persistence populate or inspect its fields directly.
+type configMock struct {
+	staticKeypair *noise.DHKey
+	devicePubkeys map[string]bool
+}
 
 func (config *configMock) ContainsDeviceStaticPubkey(pubkey []byte) bool {
-	return false
+	return config.devicePubkeys[string(pubkey)]
 }
 func (config *configMock) AddDeviceStaticPubkey(pubkey []byte) error {
+	if config.devicePubkeys == nil {
+		config.devicePubkeys = map[string]bool{}
+	}
+	config.devicePubkeys[string(pubkey)] = true
 	return nil
 }
-func (config *configMock) GetAppNoiseStaticKeypair() *noise.DHKey {
+func (config *configMock) RemoveDeviceStaticPubkey(pubkey []byte) error {
+	delete(config.devicePubkeys, string(pubkey))
 	return nil
 }
+func (config *configMock) GetAppNoiseStaticKeypair() *noise.DHKey {
+	return config.staticKeypair
+}
 func (config *configMock) SetAppNoiseStaticKeypair(key *noise.DHKey) error {
+	config.staticKeypair = key
 	return nil
 }
 
@@ -80,10 +124,17 @@ func newDevice(
 	onRequest func(*messages.Request) *messages.Response,
 ) *firmware.Device {
 
+	rootPubkey, rootKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	var rootIdentifier [32]byte
+	copy(rootIdentifier[:], "test-root")
+	_, deviceKey, attestationPayload := makeAttestation(t, rootIdentifier, rootKey)
+
 	device := firmware.NewDevice(
 		version,
 		&product,
 		&configMock{}, communication, &loggerMock{},
+		firmware.WithAttestationRoots(firmware.NewAttestationRoot(rootIdentifier, rootPubkey)),
 	)
 
 	cipherSuite := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
@@ -102,6 +153,14 @@ func newDevice(
 	var sendCipher, receiveCipher *noise.CipherState
 	shakingHands := false
 
+	// paired becomes true once the Noise handshake completes (and, if the device had required
+	// it, pairing verification succeeds - it never does in this mock, see the 'v' case below).
+	// From then on every query is an encrypted protobuf message, not an opcode: pre-4.0.0
+	// firmware sends it with no prefix at all, so its first ciphertext byte is just whatever it
+	// happens to be, not a meaningful opcode. Dispatching such a message through the opcode
+	// switch below would misroute it whenever that random byte happens to collide with 'a', 'u',
+	// 'h' or 'v' - so once paired, go straight to handleProtobufMsg and skip the switch entirely.
+	paired := false
 	var handleRequest func(request *messages.Request) *messages.Response
 	communication.query = func(msg []byte) ([]byte, error) {
 		if shakingHands {
@@ -111,6 +170,7 @@ func newDevice(
 			require.Equal(t, sendCipher == nil, receiveCipher == nil)
 			if sendCipher != nil { // handshake done
 				shakingHands = false
+				paired = true
 				return []byte{0}, nil // 0 = do not require pairing verification
 			}
 			msgSend, _, _, err := handshake.WriteMessage(nil, nil)
@@ -130,7 +190,17 @@ func newDevice(
 
 			responseBytes, err := proto.Marshal(response)
 			require.NoError(t, err)
-			return sendCipher.Encrypt(nil, nil, responseBytes), nil
+			encrypted, err := sendCipher.Encrypt(nil, nil, responseBytes)
+			require.NoError(t, err)
+			return encrypted, nil
+		}
+
+		if paired {
+			if version.AtLeast(semver.NewSemVer(4, 0, 0)) {
+				require.Equal(t, byte('n'), msg[0]) // OP_NOISE_MSG
+				return handleProtobufMsg(msg[1:])
+			}
+			return handleProtobufMsg(msg)
 		}
 
 		switch msg[0] {
@@ -138,7 +208,11 @@ func newDevice(
 			if !version.AtLeast(semver.NewSemVer(2, 0, 0)) {
 				break
 			}
-			return make([]byte, 1+32+64+64+32+64), nil
+			if len(msg) > 1 {
+				// Challenge to be signed by the device's attested key, see firmware.Attestation().
+				return ed25519.Sign(deviceKey, msg[1:]), nil
+			}
+			return attestationPayload, nil
 		case byte('u'): // OP_UNLOCK
 			if !version.AtLeast(semver.NewSemVer(2, 0, 0)) {
 				break
@@ -150,11 +224,6 @@ func newDevice(
 		case byte('v'): // OP_I_CAN_HAS_PAIRIN_VERIFICASHUN
 			// confirm pairing
 			return []byte{0x00}, nil // OP_STATUS_SUCCESS
-		case byte('n'): // OP_NOISE_MSG
-			if !version.AtLeast(semver.NewSemVer(4, 0, 0)) {
-				break
-			}
-			return handleProtobufMsg(msg[1:])
 		}
 		return handleProtobufMsg(msg)
 	}
@@ -277,6 +346,48 @@ func testConfigurations(t *testing.T, run func(*testEnv, *testing.T)) {
 	}
 }
 
+// assertEventSequence subscribes to env.device's event bus, runs op, and asserts that the types of
+// events emitted by op (in order) equal expected.
+func assertEventSequence(t *testing.T, env *testEnv, expected []firmware.EventType, op func()) {
+	events, cancel := env.device.Subscribe()
+	defer cancel()
+
+	op()
+
+	got := []firmware.EventType{}
+	for {
+		select {
+		case event := <-events:
+			got = append(got, event.Type)
+		default:
+			require.Equal(t, expected, got)
+			return
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	testConfigurations(t, func(env *testEnv, t *testing.T) {
+		env.onRequest = func(request *messages.Request) *messages.Response {
+			_, ok := request.Request.(*messages.Request_DeviceInfo)
+			require.True(t, ok)
+			return &messages.Response{
+				Response: &messages.Response_DeviceInfo{
+					DeviceInfo: &messages.DeviceInfoResponse{Initialized: true},
+				},
+			}
+		}
+		assertEventSequence(t, env, []firmware.EventType{firmware.EventStatusChanged}, func() {
+			env.device.ChannelHashVerify(true)
+		})
+
+		env.communication.sendFrame = func(msg string) error { return nil }
+		assertEventSequence(t, env, []firmware.EventType{firmware.EventFirmwareUpgradeReboot}, func() {
+			require.NoError(t, env.device.UpgradeFirmware())
+		})
+	})
+}
+
 func TestVersion(t *testing.T) {
 	testConfigurations(t, func(env *testEnv, t *testing.T) {
 		require.Equal(t, env.version, env.device.Version())
@@ -366,3 +477,574 @@ func TestSetDeviceName(t *testing.T) {
 		require.Equal(t, expectedErr, env.device.SetDeviceName(expected))
 	})
 }
+
+func TestAttestation(t *testing.T) {
+	testConfigurations(t, func(env *testEnv, t *testing.T) {
+		if !env.version.AtLeast(semver.NewSemVer(2, 0, 0)) {
+			return
+		}
+		result, err := env.device.Attestation()
+		require.NoError(t, err)
+		require.True(t, result.Trusted)
+		require.Equal(t, firmware.StatusInitialized, env.device.AttestationStatus())
+		// Calling it again must not re-do the round trip; same result is returned.
+		cached, err := env.device.Attestation()
+		require.NoError(t, err)
+		require.Equal(t, result, cached)
+	})
+}
+
+// TestAttestationForged exercises a device whose attestation certificate does not chain to any
+// root trusted by the app; Attestation() must fail and mark the device StatusAttestationFailed.
+func TestAttestationForged(t *testing.T) {
+	version := semver.NewSemVer(4, 3, 0)
+	product := common.ProductBitBox02Multi
+
+	_, forgedRootKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	trustedRootPubkey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	var rootIdentifier [32]byte
+	copy(rootIdentifier[:], "test-root")
+	_, _, forgedPayload := makeAttestation(t, rootIdentifier, forgedRootKey)
+
+	communication := &communicationMock{
+		query: func(msg []byte) ([]byte, error) {
+			require.Equal(t, byte('a'), msg[0])
+			return forgedPayload, nil
+		},
+	}
+	device := firmware.NewDevice(
+		version, &product, &configMock{}, communication, &loggerMock{},
+		firmware.WithAttestationRoots(firmware.NewAttestationRoot(rootIdentifier, trustedRootPubkey)),
+	)
+	_, err = device.Attestation()
+	require.Error(t, err)
+	require.Equal(t, firmware.StatusAttestationFailed, device.Status())
+}
+
+// TestInitAttestationFailed exercises Init() (rather than Attestation() directly) with a forged
+// attestation: it must stop before unlocking/pairing and leave the device StatusAttestationFailed.
+func TestInitAttestationFailed(t *testing.T) {
+	version := semver.NewSemVer(4, 3, 0)
+	product := common.ProductBitBox02Multi
+
+	_, forgedRootKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	trustedRootPubkey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	var rootIdentifier [32]byte
+	copy(rootIdentifier[:], "test-root")
+	_, _, forgedPayload := makeAttestation(t, rootIdentifier, forgedRootKey)
+
+	communication := &communicationMock{
+		query: func(msg []byte) ([]byte, error) {
+			require.Equal(t, byte('a'), msg[0])
+			return forgedPayload, nil
+		},
+	}
+	device := firmware.NewDevice(
+		version, &product, &configMock{}, communication, &loggerMock{},
+		firmware.WithAttestationRoots(firmware.NewAttestationRoot(rootIdentifier, trustedRootPubkey)),
+	)
+	require.NoError(t, device.Init())
+	require.Equal(t, firmware.StatusAttestationFailed, device.Status())
+}
+
+// TestInitDefaultAttestationRoots exercises Init() against the compiled-in attestation roots
+// (i.e. without WithAttestationRoots), which are currently a stub containing no real root pubkey
+// (see defaultAttestationRoots). Attestation must therefore fail closed - StatusAttestationFailed,
+// not a silent success - for every device until a real root is compiled in.
+func TestInitDefaultAttestationRoots(t *testing.T) {
+	version := semver.NewSemVer(4, 3, 0)
+	product := common.ProductBitBox02Multi
+
+	_, rootKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	var rootIdentifier [32]byte
+	copy(rootIdentifier[:], "test-root")
+	_, _, attestationPayload := makeAttestation(t, rootIdentifier, rootKey)
+
+	communication := &communicationMock{
+		query: func(msg []byte) ([]byte, error) {
+			require.Equal(t, byte('a'), msg[0])
+			return attestationPayload, nil
+		},
+	}
+	device := firmware.NewDevice(version, &product, &configMock{}, communication, &loggerMock{})
+	require.NoError(t, device.Init())
+	require.Equal(t, firmware.StatusAttestationFailed, device.Status())
+}
+
+// TestNegotiatedFraming exercises a device that advertises a small (64-byte) max message size
+// during the Noise handshake: Device must chunk an outgoing request and reassemble a chunked
+// response that are each larger than that, end-to-end through communicationMock.
+func TestNegotiatedFraming(t *testing.T) {
+	const deviceMaxMsgSize = 64
+
+	version := semver.NewSemVer(4, 3, 0)
+	product := common.ProductBitBox02Multi
+
+	rootPubkey, rootKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	var rootIdentifier [32]byte
+	copy(rootIdentifier[:], "test-root")
+	_, deviceKey, attestationPayload := makeAttestation(t, rootIdentifier, rootKey)
+
+	cipherSuite := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+	keypair, err := cipherSuite.GenerateKeypair(rand.Reader)
+	require.NoError(t, err)
+	handshake, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   cipherSuite,
+		Random:        rand.Reader,
+		Pattern:       noise.HandshakeXX,
+		StaticKeypair: keypair,
+		Prologue:      []byte("Noise_XX_25519_ChaChaPoly_SHA256"),
+		Initiator:     false,
+	})
+	require.NoError(t, err)
+	var sendCipher, receiveCipher *noise.CipherState
+	shakingHands := false
+
+	// deviceOptions mirrors the wire format encoded by firmware's (unexported) handshake options:
+	// a 4-byte maxMsgSize, big-endian.
+	deviceOptions := make([]byte, 4)
+	deviceOptions[3] = deviceMaxMsgSize
+
+	var handleRequest func(*messages.Request) *messages.Response
+	var requestBuffer []byte
+	var pendingResponseFrames [][]byte
+
+	communication := &communicationMock{}
+	communication.query = func(msg []byte) ([]byte, error) {
+		if shakingHands {
+			var err error
+			_, receiveCipher, sendCipher, err = handshake.ReadMessage(nil, msg)
+			require.NoError(t, err)
+			require.Equal(t, sendCipher == nil, receiveCipher == nil)
+			if sendCipher != nil { // handshake done
+				shakingHands = false
+				return []byte{0}, nil // 0 = do not require pairing verification
+			}
+			msgSend, _, _, err := handshake.WriteMessage(nil, deviceOptions)
+			require.NoError(t, err)
+			return msgSend, nil
+		}
+
+		switch msg[0] {
+		case byte('a'): // OP_ATTESTATION
+			if len(msg) > 1 {
+				return ed25519.Sign(deviceKey, msg[1:]), nil
+			}
+			return attestationPayload, nil
+		case byte('u'): // OP_UNLOCK
+			return []byte{0x02}, nil // OP_STATUS_FAILURE_UNINITIALIZED
+		case byte('h'): // OP_I_CAN_HAS_HANDSHAKE
+			shakingHands = true
+			return []byte{0x00}, nil
+		case byte('v'): // OP_I_CAN_HAS_PAIRIN_VERIFICASHUN
+			return []byte{0x00}, nil
+		case byte('n'): // OP_NOISE_MSG, now framed as [opcode][chunk flag][chunk]
+			require.GreaterOrEqual(t, len(msg), 2)
+			flag, chunk := msg[1], msg[2:]
+
+			if len(pendingResponseFrames) > 0 {
+				// A pull for the next response chunk; the request was already fully received
+				// and answered when the final request chunk arrived below.
+				require.Equal(t, byte(0x00), flag)
+				require.Empty(t, chunk)
+				next := pendingResponseFrames[0]
+				pendingResponseFrames = pendingResponseFrames[1:]
+				return next, nil
+			}
+
+			requestBuffer = append(requestBuffer, chunk...)
+			if flag == 0x01 { // more request chunks to come
+				require.LessOrEqual(t, len(chunk), deviceMaxMsgSize)
+				return []byte{0x00}, nil // ack, content unused
+			}
+
+			decrypted, err := receiveCipher.Decrypt(nil, nil, requestBuffer)
+			require.NoError(t, err)
+			requestBuffer = nil
+			request := &messages.Request{}
+			require.NoError(t, proto.Unmarshal(decrypted, request))
+			response := handleRequest(request)
+			responseBytes, err := proto.Marshal(response)
+			require.NoError(t, err)
+			encrypted, err := sendCipher.Encrypt(nil, nil, responseBytes)
+			require.NoError(t, err)
+
+			frames := chunkIntoFrames(t, encrypted, deviceMaxMsgSize)
+			pendingResponseFrames = frames[1:]
+			return frames[0], nil
+		}
+		return nil, fmt.Errorf("unexpected opcode %q", msg[0])
+	}
+	device := firmware.NewDevice(
+		version, &product, &configMock{}, communication, &loggerMock{},
+		firmware.WithAttestationRoots(firmware.NewAttestationRoot(rootIdentifier, rootPubkey)),
+	)
+	require.NoError(t, device.Init())
+
+	handleRequest = func(request *messages.Request) *messages.Response {
+		_, ok := request.Request.(*messages.Request_DeviceInfo)
+		require.True(t, ok)
+		return &messages.Response{
+			Response: &messages.Response_DeviceInfo{
+				DeviceInfo: &messages.DeviceInfoResponse{
+					// Much larger than deviceMaxMsgSize: the response itself must be chunked.
+					Name:        strings.Repeat("a", 500),
+					Initialized: true,
+				},
+			},
+		}
+	}
+	deviceInfo, err := device.DeviceInfo()
+	require.NoError(t, err)
+	require.Equal(t, strings.Repeat("a", 500), deviceInfo.Name)
+
+	// A request large enough (once proto-encoded and encrypted) to not fit in one 64-byte chunk.
+	largeName := strings.Repeat("b", 64)
+	handleRequest = func(request *messages.Request) *messages.Response {
+		setDeviceName, ok := request.Request.(*messages.Request_DeviceName)
+		require.True(t, ok)
+		require.Equal(t, largeName, setDeviceName.DeviceName.Name)
+		return responseSuccess
+	}
+	require.NoError(t, device.SetDeviceName(largeName))
+}
+
+// TestNegotiatedFramingUpgradeFirmware exercises UpgradeFirmware() with a negotiated max message
+// size small enough that even the (normally tiny) encrypted reboot request must itself be split
+// across multiple SendFrame calls.
+func TestNegotiatedFramingUpgradeFirmware(t *testing.T) {
+	const deviceMaxMsgSize = 8
+
+	version := semver.NewSemVer(4, 3, 0)
+	product := common.ProductBitBox02Multi
+
+	rootPubkey, rootKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	var rootIdentifier [32]byte
+	copy(rootIdentifier[:], "test-root")
+	_, deviceKey, attestationPayload := makeAttestation(t, rootIdentifier, rootKey)
+
+	cipherSuite := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+	keypair, err := cipherSuite.GenerateKeypair(rand.Reader)
+	require.NoError(t, err)
+	handshake, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   cipherSuite,
+		Random:        rand.Reader,
+		Pattern:       noise.HandshakeXX,
+		StaticKeypair: keypair,
+		Prologue:      []byte("Noise_XX_25519_ChaChaPoly_SHA256"),
+		Initiator:     false,
+	})
+	require.NoError(t, err)
+	var sendCipher, receiveCipher *noise.CipherState
+	shakingHands := false
+
+	deviceOptions := make([]byte, 4)
+	deviceOptions[3] = deviceMaxMsgSize
+
+	var rebootRequestBuffer []byte
+	communication := &communicationMock{}
+	communication.query = func(msg []byte) ([]byte, error) {
+		if shakingHands {
+			var err error
+			_, receiveCipher, sendCipher, err = handshake.ReadMessage(nil, msg)
+			require.NoError(t, err)
+			if sendCipher != nil {
+				shakingHands = false
+				return []byte{0}, nil
+			}
+			msgSend, _, _, err := handshake.WriteMessage(nil, deviceOptions)
+			require.NoError(t, err)
+			return msgSend, nil
+		}
+		switch msg[0] {
+		case byte('a'):
+			if len(msg) > 1 {
+				return ed25519.Sign(deviceKey, msg[1:]), nil
+			}
+			return attestationPayload, nil
+		case byte('u'):
+			return []byte{0x02}, nil
+		case byte('h'):
+			shakingHands = true
+			return []byte{0x00}, nil
+		case byte('v'):
+			return []byte{0x00}, nil
+		}
+		return nil, fmt.Errorf("unexpected opcode %q in query()", msg[0])
+	}
+	communication.sendFrame = func(msg string) error {
+		require.GreaterOrEqual(t, len(msg), 2)
+		require.Equal(t, byte('n'), msg[0])
+		flag, chunk := msg[1], []byte(msg)[2:]
+		require.LessOrEqual(t, len(chunk), deviceMaxMsgSize)
+		rebootRequestBuffer = append(rebootRequestBuffer, chunk...)
+		if flag == 0x00 { // final chunk
+			decrypted, err := receiveCipher.Decrypt(nil, nil, rebootRequestBuffer)
+			require.NoError(t, err)
+			request := &messages.Request{}
+			require.NoError(t, proto.Unmarshal(decrypted, request))
+			_, ok := request.Request.(*messages.Request_Reboot)
+			require.True(t, ok)
+		}
+		return nil
+	}
+
+	device := firmware.NewDevice(
+		version, &product, &configMock{}, communication, &loggerMock{},
+		firmware.WithAttestationRoots(firmware.NewAttestationRoot(rootIdentifier, rootPubkey)),
+	)
+	require.NoError(t, device.Init())
+	require.NoError(t, device.UpgradeFirmware())
+	require.NotEmpty(t, rebootRequestBuffer)
+}
+
+// chunkIntoFrames splits encrypted into <= maxSize chunks and prefixes each with a one-byte flag
+// (0x01 = more chunks follow, 0x00 = last chunk), mirroring firmware's response framing.
+func chunkIntoFrames(t *testing.T, encrypted []byte, maxSize int) [][]byte {
+	var chunks [][]byte
+	for len(encrypted) > 0 {
+		n := maxSize
+		if n > len(encrypted) {
+			n = len(encrypted)
+		}
+		chunks = append(chunks, encrypted[:n])
+		encrypted = encrypted[n:]
+	}
+	if len(chunks) == 0 {
+		chunks = [][]byte{nil}
+	}
+	frames := make([][]byte, len(chunks))
+	for i, chunk := range chunks {
+		flag := byte(0x01)
+		if i == len(chunks)-1 {
+			flag = 0x00
+		}
+		frames[i] = append([]byte{flag}, chunk...)
+	}
+	return frames
+}
+
+// newRotationTestDevice builds a device paired against a hand-rolled device simulation that can
+// run the Noise XX handshake more than once, so RotateAppNoiseKey's re-handshake can be exercised.
+// If reuseDeviceKeypair is false, the device side generates a fresh static keypair for every
+// handshake (unlike a real BitBox02, whose own identity does not change across an app-side key
+// rotation), so tests can tell the app's "old" and "new" trusted device pubkey apart. If it is
+// true, the device keeps the same static keypair across handshakes, as a real device would.
+// pairingAccepted controls what OP_I_CAN_HAS_PAIRIN_VERIFICASHUN answers for every handshake run
+// after the device hands it back, including the initial one.
+func newRotationTestDevice(
+	t *testing.T, config *configMock, pairingAccepted *bool, reuseDeviceKeypair bool,
+) (*firmware.Device, *messages.DeviceInfoResponse) {
+	rootPubkey, rootKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	var rootIdentifier [32]byte
+	copy(rootIdentifier[:], "test-root")
+	_, deviceKey, attestationPayload := makeAttestation(t, rootIdentifier, rootKey)
+
+	cipherSuite := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+
+	communication := &communicationMock{}
+	version := semver.NewSemVer(4, 3, 0)
+	product := common.ProductBitBox02Multi
+	device := firmware.NewDevice(
+		version, &product, config, communication, &loggerMock{},
+		firmware.WithAttestationRoots(firmware.NewAttestationRoot(rootIdentifier, rootPubkey)),
+	)
+
+	deviceInfo := &messages.DeviceInfoResponse{Initialized: true}
+	handleRequest := func(request *messages.Request) *messages.Response {
+		_, ok := request.Request.(*messages.Request_DeviceInfo)
+		require.True(t, ok)
+		return &messages.Response{Response: &messages.Response_DeviceInfo{DeviceInfo: deviceInfo}}
+	}
+
+	var deviceHandshake *noise.HandshakeState
+	var deviceStaticKeypair noise.DHKey
+	var sendCipher, receiveCipher *noise.CipherState
+	var pendingSendCipher, pendingReceiveCipher *noise.CipherState
+	shakingHands := false
+
+	communication.query = func(msg []byte) ([]byte, error) {
+		if shakingHands {
+			_, rc, sc, err := deviceHandshake.ReadMessage(nil, msg)
+			require.NoError(t, err)
+			if sc != nil {
+				shakingHands = false
+				pendingSendCipher, pendingReceiveCipher = sc, rc
+				return []byte{0x01}, nil // always require on-device pairing verification
+			}
+			msgSend, _, _, err := deviceHandshake.WriteMessage(nil, nil)
+			require.NoError(t, err)
+			return msgSend, nil
+		}
+
+		handleProtobufMsg := func(raw []byte) ([]byte, error) {
+			decrypted, err := receiveCipher.Decrypt(nil, nil, raw)
+			require.NoError(t, err)
+			request := &messages.Request{}
+			require.NoError(t, proto.Unmarshal(decrypted, request))
+			response := handleRequest(request)
+			responseBytes, err := proto.Marshal(response)
+			require.NoError(t, err)
+			encrypted, err := sendCipher.Encrypt(nil, nil, responseBytes)
+			require.NoError(t, err)
+			return encrypted, nil
+		}
+
+		switch msg[0] {
+		case byte('a'):
+			if len(msg) > 1 {
+				return ed25519.Sign(deviceKey, msg[1:]), nil
+			}
+			return attestationPayload, nil
+		case byte('u'):
+			return []byte{0x00}, nil
+		case byte('h'):
+			if !reuseDeviceKeypair || deviceStaticKeypair.Private == nil {
+				var err error
+				deviceStaticKeypair, err = cipherSuite.GenerateKeypair(rand.Reader)
+				require.NoError(t, err)
+			}
+			var err error
+			deviceHandshake, err = noise.NewHandshakeState(noise.Config{
+				CipherSuite:   cipherSuite,
+				Random:        rand.Reader,
+				Pattern:       noise.HandshakeXX,
+				StaticKeypair: deviceStaticKeypair,
+				Prologue:      []byte("Noise_XX_25519_ChaChaPoly_SHA256"),
+				Initiator:     false,
+			})
+			require.NoError(t, err)
+			shakingHands = true
+			return []byte{0x00}, nil
+		case byte('v'):
+			if *pairingAccepted {
+				sendCipher, receiveCipher = pendingSendCipher, pendingReceiveCipher
+				return []byte{0x00}, nil
+			}
+			return []byte{0x01}, nil
+		case byte('n'):
+			return handleProtobufMsg(msg[1:])
+		}
+		return handleProtobufMsg(msg)
+	}
+
+	require.NoError(t, device.Init())
+	device.ChannelHashVerify(true)
+	require.Equal(t, firmware.StatusInitialized, device.Status())
+	return device, deviceInfo
+}
+
+// TestRotateAppNoiseKeyAborted exercises a rotation the user rejects on the device: the app's
+// keypair and its record of the device's trusted pubkey must be left exactly as they were, and the
+// existing session must remain usable.
+func TestRotateAppNoiseKeyAborted(t *testing.T) {
+	config := &configMock{}
+	pairingAccepted := true
+	device, _ := newRotationTestDevice(t, config, &pairingAccepted, false)
+
+	originalKeypair := config.staticKeypair
+	originalDevicePubkeys := map[string]bool{}
+	for pubkey, trusted := range config.devicePubkeys {
+		originalDevicePubkeys[pubkey] = trusted
+	}
+	require.NotEmpty(t, originalDevicePubkeys)
+
+	pairingAccepted = false
+	err := device.RotateAppNoiseKey(context.Background())
+	require.Error(t, err)
+
+	require.Equal(t, originalKeypair, config.staticKeypair)
+	require.Equal(t, originalDevicePubkeys, config.devicePubkeys)
+
+	// The old session is unaffected by the aborted rotation.
+	info, err := device.DeviceInfo()
+	require.NoError(t, err)
+	require.True(t, info.Initialized)
+}
+
+// TestRotateAppNoiseKeySucceeded exercises a rotation the user accepts on the device: a new
+// keypair is persisted, the device's previous trusted pubkey is replaced by its new one, and the
+// device is usable under the new session immediately afterwards.
+func TestRotateAppNoiseKeySucceeded(t *testing.T) {
+	config := &configMock{}
+	pairingAccepted := true
+	device, _ := newRotationTestDevice(t, config, &pairingAccepted, false)
+
+	originalKeypair := config.staticKeypair
+	var originalDevicePubkey string
+	for pubkey := range config.devicePubkeys {
+		originalDevicePubkey = pubkey
+	}
+	require.NotEmpty(t, originalDevicePubkey)
+
+	require.NoError(t, device.RotateAppNoiseKey(context.Background()))
+
+	require.NotEqual(t, originalKeypair, config.staticKeypair)
+	require.NotNil(t, config.staticKeypair)
+	require.False(t, config.devicePubkeys[originalDevicePubkey])
+	require.Len(t, config.devicePubkeys, 1)
+
+	info, err := device.DeviceInfo()
+	require.NoError(t, err)
+	require.True(t, info.Initialized)
+}
+
+// TestRotateAppNoiseKeySucceededSameDeviceIdentity exercises a rotation against a device whose
+// static pubkey does not change across handshakes, as a real BitBox02's would not: the app's trust
+// of that pubkey must survive the rotation, not be wiped out by it.
+func TestRotateAppNoiseKeySucceededSameDeviceIdentity(t *testing.T) {
+	config := &configMock{}
+	pairingAccepted := true
+	device, _ := newRotationTestDevice(t, config, &pairingAccepted, true)
+
+	var devicePubkey string
+	for pubkey := range config.devicePubkeys {
+		devicePubkey = pubkey
+	}
+	require.NotEmpty(t, devicePubkey)
+
+	require.NoError(t, device.RotateAppNoiseKey(context.Background()))
+
+	require.True(t, config.devicePubkeys[devicePubkey])
+	require.Len(t, config.devicePubkeys, 1)
+
+	info, err := device.DeviceInfo()
+	require.NoError(t, err)
+	require.True(t, info.Initialized)
+}
+
+// TestRotateAppNoiseKeyUnsupportedFirmware exercises the pre-4.0.0 firmware path, where OP_NOISE
+// framing (and the re-handshake it would require) is not available.
+func TestRotateAppNoiseKeyUnsupportedFirmware(t *testing.T) {
+	version := semver.NewSemVer(3, 0, 0)
+	product := common.ProductBitBox02Multi
+	communication := &communicationMock{}
+	device := newDevice(t, version, product, communication, func(*messages.Request) *messages.Response {
+		t.Fatal("unexpected request")
+		return nil
+	})
+
+	err := device.RotateAppNoiseKey(context.Background())
+	require.Error(t, err)
+	var unsupported *firmware.ErrUnsupportedByFirmware
+	require.True(t, errors.As(err, &unsupported))
+}
+
+// TestForgetDevice exercises clearing the app's trust of the currently-paired device.
+func TestForgetDevice(t *testing.T) {
+	config := &configMock{}
+	pairingAccepted := true
+	device, _ := newRotationTestDevice(t, config, &pairingAccepted, false)
+	require.NotEmpty(t, config.devicePubkeys)
+
+	require.NoError(t, device.ForgetDevice())
+	require.Empty(t, config.devicePubkeys)
+}
@@ -0,0 +1,69 @@
+// Copyright 2018-2019 Shift Cryptosecurity AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package enroll
+
+import (
+	"context"
+
+	"github.com/digitalbitbox/bitbox02-api-go/api/firmware"
+	"github.com/digitalbitbox/bitbox02-api-go/api/firmware/messages"
+)
+
+// DeviceCollectedData is gathered from the device and sent to Backend.CreateDeviceInit to start
+// the ceremony.
+type DeviceCollectedData struct {
+	DeviceIdentifier string
+	Attestation      *firmware.AttestationResult
+	DeviceInfo       *messages.DeviceInfoResponse
+}
+
+// EnrollChallenge is returned by Backend.CreateDeviceInit.
+type EnrollChallenge struct {
+	// Nonce is signed by the device's attested key and sent back via CreateDeviceFinish. Must be
+	// exactly 32 bytes (see firmware.Device.SignAttestationChallenge). Empty if AlreadyEnrolled is
+	// true.
+	Nonce []byte
+	// AlreadyEnrolled is true if the backend already holds a credential for this device; Register
+	// then skips the challenge round trip with the device entirely.
+	AlreadyEnrolled bool
+	// Credential is the previously issued credential, populated only if AlreadyEnrolled is true.
+	Credential DeviceCredential
+}
+
+// ChallengeResponse is sent to Backend.CreateDeviceFinish once the device has signed the nonce
+// from EnrollChallenge.
+type ChallengeResponse struct {
+	DeviceIdentifier string
+	Nonce            []byte
+	Signature        []byte
+}
+
+// DeviceCredential is backend-issued proof that the device is registered and/or enrolled.
+type DeviceCredential struct {
+	Credential []byte
+	// Registered is true if this call caused the backend to record the device for the first
+	// time.
+	Registered bool
+	// Enrolled is true if this call caused the device to become enrolled for the caller.
+	Enrolled bool
+}
+
+// Backend is implemented by the host application's device-trust service. CreateDeviceInit and
+// CreateDeviceFinish should return a *QuotaError when the caller's device quota is exhausted, so
+// Register's caller can distinguish it from other protocol/transport errors.
+type Backend interface {
+	CreateDeviceInit(ctx context.Context, data DeviceCollectedData) (EnrollChallenge, error)
+	CreateDeviceFinish(ctx context.Context, response ChallengeResponse) (DeviceCredential, error)
+}
@@ -0,0 +1,104 @@
+// Copyright 2018-2019 Shift Cryptosecurity AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package enroll implements a device-trust enrollment ceremony on top of an already-paired
+// firmware.Device: the device's attestation is collected and signed over a backend-issued
+// challenge, so the backend can register and/or enroll the device without ever seeing its
+// private key.
+package enroll
+
+import (
+	"context"
+
+	"github.com/digitalbitbox/bitbox02-api-go/api/firmware"
+	"github.com/digitalbitbox/bitbox02-api-go/util/errp"
+)
+
+// Outcome describes what Register did for this device.
+type Outcome string
+
+const (
+	// DeviceRegistered means the backend recorded the device for the first time, but did not also
+	// enroll it for this caller in the same call - an unusual backend response, since
+	// CreateDeviceInit already ruled out AlreadyEnrolled before CreateDeviceFinish is reached.
+	DeviceRegistered Outcome = "device_registered"
+	// DeviceEnrolled means the device was already registered with the backend and has now been
+	// enrolled for this caller.
+	DeviceEnrolled Outcome = "device_enrolled"
+	// RegisteredAndEnrolled means both registration and enrollment happened in this call.
+	RegisteredAndEnrolled Outcome = "registered_and_enrolled"
+	// AlreadyEnrolled means the device was already enrolled; the challenge round trip with the
+	// device was skipped.
+	AlreadyEnrolled Outcome = "already_enrolled"
+)
+
+// Result is returned by Register.
+type Result struct {
+	Outcome    Outcome
+	Credential DeviceCredential
+}
+
+// Register runs the two-phase Register->Enroll ceremony against device, using backend as the
+// device-trust service: it collects the device's attestation and info, asks backend for a
+// challenge, has the device sign it with its attested key, and exchanges the signature for a
+// backend-issued credential.
+//
+// Register is idempotent: if backend reports the device as already enrolled, the challenge
+// round trip with the device is skipped and AlreadyEnrolled is returned.
+func Register(ctx context.Context, device *firmware.Device, backend Backend) (*Result, error) {
+	attestation, err := device.Attestation()
+	if err != nil {
+		return nil, errp.WithMessage(err, "device attestation failed")
+	}
+	deviceInfo, err := device.DeviceInfo()
+	if err != nil {
+		return nil, errp.WithMessage(err, "could not query device info")
+	}
+
+	collected := DeviceCollectedData{
+		DeviceIdentifier: attestation.DeviceIdentifier(),
+		Attestation:      attestation,
+		DeviceInfo:       deviceInfo,
+	}
+	challenge, err := backend.CreateDeviceInit(ctx, collected)
+	if err != nil {
+		return nil, err
+	}
+	if challenge.AlreadyEnrolled {
+		return &Result{Outcome: AlreadyEnrolled, Credential: challenge.Credential}, nil
+	}
+
+	signature, err := device.SignAttestationChallenge(challenge.Nonce)
+	if err != nil {
+		return nil, errp.WithMessage(err, "could not sign enrollment challenge")
+	}
+
+	credential, err := backend.CreateDeviceFinish(ctx, ChallengeResponse{
+		DeviceIdentifier: collected.DeviceIdentifier,
+		Nonce:            challenge.Nonce,
+		Signature:        signature,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	outcome := DeviceEnrolled
+	switch {
+	case credential.Registered && credential.Enrolled:
+		outcome = RegisteredAndEnrolled
+	case credential.Registered:
+		outcome = DeviceRegistered
+	}
+	return &Result{Outcome: outcome, Credential: credential}, nil
+}
@@ -0,0 +1,237 @@
+// Copyright 2018-2019 Shift Cryptosecurity AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package enroll_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/digitalbitbox/bitbox02-api-go/api/common"
+	"github.com/digitalbitbox/bitbox02-api-go/api/firmware"
+	"github.com/digitalbitbox/bitbox02-api-go/api/firmware/enroll"
+	"github.com/digitalbitbox/bitbox02-api-go/api/firmware/messages"
+	"github.com/digitalbitbox/bitbox02-api-go/util/semver"
+	"github.com/flynn/noise"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+type communicationMock struct {
+	sendFrame func(msg string) error
+	query     func([]byte) ([]byte, error)
+}
+
+func (communication *communicationMock) SendFrame(msg string) error {
+	return communication.sendFrame(msg)
+}
+func (communication *communicationMock) Query(msg []byte) ([]byte, error) {
+	return communication.query(msg)
+}
+func (communication *communicationMock) Close() {}
+
+type configMock struct{}
+
+func (configMock) ContainsDeviceStaticPubkey([]byte) bool      { return false }
+func (configMock) AddDeviceStaticPubkey([]byte) error          { return nil }
+func (configMock) RemoveDeviceStaticPubkey([]byte) error       { return nil }
+func (configMock) GetAppNoiseStaticKeypair() *noise.DHKey      { return nil }
+func (configMock) SetAppNoiseStaticKeypair(*noise.DHKey) error { return nil }
+
+type loggerMock struct{}
+
+func (loggerMock) Error(string, error) {}
+func (loggerMock) Info(string)         {}
+func (loggerMock) Debug(string)        {}
+
+// newPairedDevice builds a fully paired, attested firmware.Device backed by an in-process mock
+// transport, analogous to firmware_test's newDevice() helper.
+func newPairedDevice(t *testing.T) *firmware.Device {
+	rootPubkey, rootKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	var rootIdentifier [32]byte
+	copy(rootIdentifier[:], "test-root")
+
+	devicePubkey, deviceKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	certificate := ed25519.Sign(rootKey, devicePubkey)
+	attestationPayload := make([]byte, 1+32+64+64+32+64)
+	offset := 1 + 32
+	copy(attestationPayload[offset:], devicePubkey)
+	offset += 64
+	copy(attestationPayload[offset:], certificate)
+	offset += 64
+	copy(attestationPayload[offset:], rootIdentifier[:])
+
+	version := semver.NewSemVer(4, 3, 0)
+	product := common.ProductBitBox02Multi
+
+	communication := &communicationMock{}
+	device := firmware.NewDevice(
+		version, &product, configMock{}, communication, loggerMock{},
+		firmware.WithAttestationRoots(firmware.NewAttestationRoot(rootIdentifier, rootPubkey)),
+	)
+
+	cipherSuite := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+	keypair, err := cipherSuite.GenerateKeypair(rand.Reader)
+	require.NoError(t, err)
+	handshake, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   cipherSuite,
+		Random:        rand.Reader,
+		Pattern:       noise.HandshakeXX,
+		StaticKeypair: keypair,
+		Prologue:      []byte("Noise_XX_25519_ChaChaPoly_SHA256"),
+		Initiator:     false,
+	})
+	require.NoError(t, err)
+	var sendCipher, receiveCipher *noise.CipherState
+	shakingHands := false
+
+	communication.query = func(msg []byte) ([]byte, error) {
+		if shakingHands {
+			var err error
+			_, receiveCipher, sendCipher, err = handshake.ReadMessage(nil, msg)
+			require.NoError(t, err)
+			if sendCipher != nil {
+				shakingHands = false
+				return []byte{0}, nil
+			}
+			msgSend, _, _, err := handshake.WriteMessage(nil, nil)
+			require.NoError(t, err)
+			return msgSend, nil
+		}
+		switch msg[0] {
+		case byte('a'):
+			if len(msg) > 1 {
+				return ed25519.Sign(deviceKey, msg[1:]), nil
+			}
+			return attestationPayload, nil
+		case byte('u'):
+			return []byte{0x00}, nil
+		case byte('h'):
+			shakingHands = true
+			return []byte{0x00}, nil
+		case byte('v'):
+			return []byte{0x00}, nil
+		case byte('n'):
+			decrypted, err := receiveCipher.Decrypt(nil, nil, msg[1:])
+			require.NoError(t, err)
+			request := &messages.Request{}
+			require.NoError(t, proto.Unmarshal(decrypted, request))
+			response := &messages.Response{
+				Response: &messages.Response_DeviceInfo{
+					DeviceInfo: &messages.DeviceInfoResponse{Name: "test", Initialized: true},
+				},
+			}
+			responseBytes, err := proto.Marshal(response)
+			require.NoError(t, err)
+			encrypted, err := sendCipher.Encrypt(nil, nil, responseBytes)
+			require.NoError(t, err)
+			return encrypted, nil
+		}
+		return nil, nil
+	}
+
+	require.NoError(t, device.Init())
+	device.ChannelHashVerify(true)
+	require.Equal(t, firmware.StatusInitialized, device.Status())
+	return device
+}
+
+// fakeBackend is an in-memory Backend used to exercise Register's three enrollment states.
+type fakeBackend struct {
+	registered map[string]bool
+	enrolled   map[string]bool
+	quotaFull  bool
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{registered: map[string]bool{}, enrolled: map[string]bool{}}
+}
+
+func (backend *fakeBackend) CreateDeviceInit(
+	ctx context.Context, data enroll.DeviceCollectedData,
+) (enroll.EnrollChallenge, error) {
+	if backend.enrolled[data.DeviceIdentifier] {
+		return enroll.EnrollChallenge{
+			AlreadyEnrolled: true,
+			Credential:      enroll.DeviceCredential{Credential: []byte("cached-credential")},
+		}, nil
+	}
+	if backend.quotaFull && !backend.registered[data.DeviceIdentifier] {
+		return enroll.EnrollChallenge{}, &enroll.QuotaError{Limit: 1}
+	}
+	return enroll.EnrollChallenge{Nonce: make([]byte, 32)}, nil
+}
+
+func (backend *fakeBackend) CreateDeviceFinish(
+	ctx context.Context, response enroll.ChallengeResponse,
+) (enroll.DeviceCredential, error) {
+	wasRegistered := backend.registered[response.DeviceIdentifier]
+	backend.registered[response.DeviceIdentifier] = true
+	backend.enrolled[response.DeviceIdentifier] = true
+	return enroll.DeviceCredential{
+		Credential: []byte("credential"),
+		Registered: !wasRegistered,
+		Enrolled:   true,
+	}, nil
+}
+
+func TestRegister(t *testing.T) {
+	t.Run("non-existing device is registered and enrolled", func(t *testing.T) {
+		device := newPairedDevice(t)
+		backend := newFakeBackend()
+		result, err := enroll.Register(context.Background(), device, backend)
+		require.NoError(t, err)
+		require.Equal(t, enroll.RegisteredAndEnrolled, result.Outcome)
+		require.Equal(t, []byte("credential"), result.Credential.Credential)
+	})
+
+	t.Run("registered-not-enrolled device is enrolled without re-registering", func(t *testing.T) {
+		device := newPairedDevice(t)
+		backend := newFakeBackend()
+		_, err := enroll.Register(context.Background(), device, backend)
+		require.NoError(t, err)
+		backend.enrolled = map[string]bool{} // simulate enrollment revoked for this caller
+
+		result, err := enroll.Register(context.Background(), device, backend)
+		require.NoError(t, err)
+		require.Equal(t, enroll.DeviceEnrolled, result.Outcome)
+	})
+
+	t.Run("fully-enrolled device is idempotent and skips the challenge round trip", func(t *testing.T) {
+		device := newPairedDevice(t)
+		backend := newFakeBackend()
+		_, err := enroll.Register(context.Background(), device, backend)
+		require.NoError(t, err)
+
+		result, err := enroll.Register(context.Background(), device, backend)
+		require.NoError(t, err)
+		require.Equal(t, enroll.AlreadyEnrolled, result.Outcome)
+		require.Equal(t, []byte("cached-credential"), result.Credential.Credential)
+	})
+
+	t.Run("quota exceeded surfaces a typed error", func(t *testing.T) {
+		device := newPairedDevice(t)
+		backend := newFakeBackend()
+		backend.quotaFull = true
+		_, err := enroll.Register(context.Background(), device, backend)
+		require.Error(t, err)
+		var quotaErr *enroll.QuotaError
+		require.ErrorAs(t, err, &quotaErr)
+		require.Equal(t, 1, quotaErr.Limit)
+	})
+}
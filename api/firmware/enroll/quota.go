@@ -0,0 +1,28 @@
+// Copyright 2018-2019 Shift Cryptosecurity AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package enroll
+
+import "fmt"
+
+// QuotaError is returned by a Backend when the caller's device quota has been exhausted. Callers
+// can use errors.As to distinguish it from protocol/transport errors returned by Register.
+type QuotaError struct {
+	Limit int
+}
+
+// Error implements the error interface.
+func (err *QuotaError) Error() string {
+	return fmt.Sprintf("device quota exceeded (limit %d)", err.Limit)
+}
@@ -0,0 +1,36 @@
+// Copyright 2018-2019 Shift Cryptosecurity AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firmware
+
+import (
+	"fmt"
+
+	"github.com/digitalbitbox/bitbox02-api-go/util/semver"
+)
+
+// ErrUnsupportedByFirmware is returned by Device methods that require a firmware feature not
+// present on the connected device's firmware version. Callers can type-assert on it to tell this
+// apart from a communication or protocol error.
+type ErrUnsupportedByFirmware struct {
+	// Feature names the method or capability that was attempted.
+	Feature string
+	// Minimum is the lowest firmware version that supports Feature.
+	Minimum *semver.SemVer
+}
+
+// Error implements error.
+func (err *ErrUnsupportedByFirmware) Error() string {
+	return fmt.Sprintf("%s requires firmware >= %s", err.Feature, err.Minimum)
+}
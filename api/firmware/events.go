@@ -0,0 +1,118 @@
+// Copyright 2018-2019 Shift Cryptosecurity AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firmware
+
+import "sync"
+
+// eventBufferSize bounds how many undelivered events a slow subscriber can accumulate before new
+// events are dropped for it; the monotonic Seq on Event lets such a subscriber detect the gap.
+const eventBufferSize = 16
+
+// EventType identifies what an Event represents.
+type EventType string
+
+const (
+	// EventHandshakeStarted is emitted when the Noise pairing handshake begins.
+	EventHandshakeStarted EventType = "handshake_started"
+	// EventPairingVerificationRequired is emitted when the device asks the user to confirm the
+	// pairing code shown by both the app and the device.
+	EventPairingVerificationRequired EventType = "pairing_verification_required"
+	// EventFirmwareUpgradeReboot is emitted once the request to reboot into the bootloader for a
+	// firmware upgrade has been sent to the device; it is not emitted if sending fails.
+	EventFirmwareUpgradeReboot EventType = "firmware_upgrade_reboot"
+	// EventStatusChanged is emitted whenever Device.Status() changes; Event.Status carries the
+	// new value.
+	EventStatusChanged EventType = "status_changed"
+	// EventError is emitted alongside calls to Logger.Error, so subscribers can observe failures
+	// without depending on the app's logging backend.
+	EventError EventType = "error"
+)
+
+// Event is a single notification emitted on the bus returned by Device.Subscribe.
+type Event struct {
+	// Seq is monotonically increasing per Device, starting at 1. A subscriber that sees a gap in
+	// Seq knows it missed events because it was not keeping up.
+	Seq uint64
+	// Type identifies what kind of event this is; the other fields are populated accordingly.
+	Type EventType
+	// Status is populated for EventStatusChanged.
+	Status Status
+	// Message is populated for EventError.
+	Message string
+}
+
+// Subscribe returns a channel of Events and a cancel function. The channel is buffered and
+// delivery is non-blocking: if the subscriber does not keep up, further events are dropped for it
+// until it catches up (detectable via a gap in Event.Seq). Call cancel to stop receiving and
+// release the subscription; it is safe to call more than once.
+func (device *Device) Subscribe() (<-chan Event, func()) {
+	device.eventsMu.Lock()
+	defer device.eventsMu.Unlock()
+
+	if device.eventSubscribers == nil {
+		device.eventSubscribers = map[int]chan Event{}
+	}
+	id := device.nextSubscriberID
+	device.nextSubscriberID++
+	channel := make(chan Event, eventBufferSize)
+	device.eventSubscribers[id] = channel
+
+	var cancelOnce sync.Once
+	cancel := func() {
+		cancelOnce.Do(func() {
+			device.eventsMu.Lock()
+			defer device.eventsMu.Unlock()
+			delete(device.eventSubscribers, id)
+			close(channel)
+		})
+	}
+	return channel, cancel
+}
+
+// emit fans event out to all current subscribers, stamping it with the next sequence number.
+func (device *Device) emit(event Event) {
+	device.eventsMu.Lock()
+	defer device.eventsMu.Unlock()
+	device.emitLocked(event)
+}
+
+// emitLocked is emit without acquiring eventsMu; callers must already hold it.
+func (device *Device) emitLocked(event Event) {
+	device.eventSeq++
+	event.Seq = device.eventSeq
+	for _, channel := range device.eventSubscribers {
+		select {
+		case channel <- event:
+		default:
+			// Subscriber is not keeping up; drop rather than block the device.
+		}
+	}
+}
+
+// setStatus updates the device status and emits EventStatusChanged. device.status is guarded by
+// eventsMu (not a separate lock) so Status() always observes a status consistent with the events
+// already delivered up to it.
+func (device *Device) setStatus(status Status) {
+	device.eventsMu.Lock()
+	defer device.eventsMu.Unlock()
+	device.status = status
+	device.emitLocked(Event{Type: EventStatusChanged, Status: status})
+}
+
+// logError reports err both through the configured Logger and the event bus.
+func (device *Device) logError(msg string, err error) {
+	device.log.Error(msg, err)
+	device.emit(Event{Type: EventError, Message: msg})
+}
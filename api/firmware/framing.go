@@ -0,0 +1,169 @@
+// Copyright 2018-2019 Shift Cryptosecurity AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firmware
+
+import (
+	"encoding/binary"
+
+	"github.com/digitalbitbox/bitbox02-api-go/util/errp"
+	"github.com/digitalbitbox/bitbox02-api-go/util/semver"
+)
+
+// defaultMaxMsgSize is what this side advertises as its own framing capability during handshake
+// negotiation (see pair()). It is not a hard protocol limit, just a generous cap on how large a
+// single opNoiseMsg frame this library will produce or accept.
+const defaultMaxMsgSize = 1 << 16 // 64 KiB
+
+const (
+	// chunkMore marks a frame (request or response) as not the last one of the logical message;
+	// more chunks follow.
+	chunkMore byte = 0x01
+	// chunkFinal marks a frame as the last one. On the request side, an empty chunkFinal frame
+	// also doubles as "send me the next response chunk" once the request itself is fully sent.
+	chunkFinal byte = 0x00
+
+	// maxChunksPerMessage bounds how many response chunks sendChunked will pull for a single
+	// message, so a device that never sets chunkFinal (firmware bug, or desync after an earlier
+	// error) can't wedge the caller in an infinite loop.
+	maxChunksPerMessage = 1 << 16
+)
+
+// noiseFraming is how an encrypted Noise transport message is put on the wire, decided once per
+// message from the current negotiation state and firmware version.
+type noiseFraming int
+
+const (
+	// framingLegacy is the original pre-4.0.0 wire format: the raw ciphertext, no opcode prefix.
+	framingLegacy noiseFraming = iota
+	// framingPlain is today's >=4.0.0, non-negotiated format: a single opNoiseMsg-prefixed frame.
+	framingPlain
+	// framingChunked is used once pair() has negotiated a non-zero max message size.
+	framingChunked
+)
+
+// noiseFraming reports how to frame an encrypted Noise payload for this device.
+func (device *Device) noiseFraming() noiseFraming {
+	switch {
+	case device.negotiatedMaxMsgSize > 0:
+		return framingChunked
+	case device.version.AtLeast(semver.NewSemVer(4, 0, 0)):
+		return framingPlain
+	default:
+		return framingLegacy
+	}
+}
+
+// handshakeOptions is exchanged as the payload of the first two Noise handshake messages (see
+// pair()) to negotiate framing. It is a single append-only field today; future fields can be added
+// after maxMsgSize without a new protocol version, since a peer that does not recognize them will
+// simply not have been written by this code yet.
+type handshakeOptions struct {
+	maxMsgSize uint32
+}
+
+// encodeHandshakeOptions serializes opts as a 4-byte maxMsgSize.
+func encodeHandshakeOptions(opts handshakeOptions) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, opts.maxMsgSize)
+	return buf
+}
+
+// decodeHandshakeOptions parses the format written by encodeHandshakeOptions. It returns an error
+// for a payload too short to contain maxMsgSize, which is how we detect a peer that did not send
+// (or understand) this options block at all.
+func decodeHandshakeOptions(data []byte) (handshakeOptions, error) {
+	if len(data) < 4 {
+		return handshakeOptions{}, errp.New("missing handshake options")
+	}
+	return handshakeOptions{maxMsgSize: binary.BigEndian.Uint32(data[0:4])}, nil
+}
+
+// chunkPayload splits payload into pieces of at most maxSize bytes. A payload that already fits
+// (or maxSize <= 0) is returned as a single chunk, including a single empty chunk for an empty
+// payload.
+func chunkPayload(payload []byte, maxSize int) [][]byte {
+	if maxSize <= 0 || len(payload) <= maxSize {
+		return [][]byte{payload}
+	}
+	var chunks [][]byte
+	for len(payload) > 0 {
+		n := maxSize
+		if n > len(payload) {
+			n = len(payload)
+		}
+		chunks = append(chunks, payload[:n])
+		payload = payload[n:]
+	}
+	return chunks
+}
+
+// sendChunked sends payload (an encrypted Noise transport message) as one or more opNoiseMsg
+// frames, none larger than device.negotiatedMaxMsgSize, and reassembles the device's (possibly
+// also chunked) response. Callers must only use this once pair() has established a non-zero
+// device.negotiatedMaxMsgSize; otherwise use the single-frame path those callers already have.
+func (device *Device) sendChunked(payload []byte) ([]byte, error) {
+	chunks := chunkPayload(payload, int(device.negotiatedMaxMsgSize))
+
+	var final []byte
+	for i, chunk := range chunks {
+		flag := chunkMore
+		if i == len(chunks)-1 {
+			flag = chunkFinal
+		}
+		response, err := device.rawQuery(append([]byte{opNoiseMsg[0], flag}, chunk...))
+		if err != nil {
+			return nil, err
+		}
+		if flag == chunkMore {
+			continue // the device just acks; the real response follows the final request chunk
+		}
+		final = response
+	}
+
+	var reassembled []byte
+	for i := 0; ; i++ {
+		if i >= maxChunksPerMessage {
+			return nil, errp.New("chunked response exceeded the maximum chunk count")
+		}
+		if len(final) == 0 {
+			return nil, errp.New("malformed chunked response")
+		}
+		reassembled = append(reassembled, final[1:]...)
+		if final[0] == chunkFinal {
+			return reassembled, nil
+		}
+		var err error
+		final, err = device.rawQuery([]byte{opNoiseMsg[0], chunkFinal})
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sendChunkedFrame is sendChunked's fire-and-forget counterpart, for callers (UpgradeFirmware)
+// that use Communication.SendFrame rather than Query because no response is expected.
+func (device *Device) sendChunkedFrame(payload []byte) error {
+	chunks := chunkPayload(payload, int(device.negotiatedMaxMsgSize))
+	for i, chunk := range chunks {
+		flag := chunkMore
+		if i == len(chunks)-1 {
+			flag = chunkFinal
+		}
+		if err := device.communication.SendFrame(string(append([]byte{opNoiseMsg[0], flag}, chunk...))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+// Copyright 2018-2019 Shift Cryptosecurity AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package errp re-exports github.com/pkg/errors so call sites get stack traces without importing
+// the upstream package directly everywhere.
+package errp
+
+import "github.com/pkg/errors"
+
+// New mirrors errors.New.
+var New = errors.New
+
+// Newf mirrors errors.Errorf.
+var Newf = errors.Errorf
+
+// WithMessage mirrors errors.WithMessage.
+var WithMessage = errors.WithMessage
+
+// WithStack mirrors errors.WithStack.
+var WithStack = errors.WithStack
+
+// Cause mirrors errors.Cause.
+var Cause = errors.Cause
@@ -0,0 +1,45 @@
+// Copyright 2018-2019 Shift Cryptosecurity AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package semver implements a minimal semantic version comparator, used to gate API behavior
+// based on the connected device's firmware version.
+package semver
+
+import "fmt"
+
+// SemVer models a `major.minor.patch` semantic version.
+type SemVer struct {
+	major, minor, patch uint64
+}
+
+// NewSemVer creates a new SemVer.
+func NewSemVer(major, minor, patch uint64) *SemVer {
+	return &SemVer{major: major, minor: minor, patch: patch}
+}
+
+// AtLeast returns true if `s` is greater than or equal to `other`.
+func (s *SemVer) AtLeast(other *SemVer) bool {
+	if s.major != other.major {
+		return s.major > other.major
+	}
+	if s.minor != other.minor {
+		return s.minor > other.minor
+	}
+	return s.patch >= other.patch
+}
+
+// String implements fmt.Stringer.
+func (s *SemVer) String() string {
+	return fmt.Sprintf("%d.%d.%d", s.major, s.minor, s.patch)
+}